@@ -0,0 +1,99 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package batcheval
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine/enginepb"
+	"github.com/cockroachdb/cockroach/pkg/storage/storagepb"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+// TestValidateExciseSpanRejectsOutOfBoundsSpan is a regression test: an
+// ExciseSpan wider than the request's own [Key, EndKey) span must be
+// rejected, since DefaultDeclareKeys never latches anything outside it.
+func TestValidateExciseSpanRejectsOutOfBoundsSpan(t *testing.T) {
+	args := &roachpb.AddSSTableRequest{
+		RequestHeader: roachpb.RequestHeader{Key: roachpb.Key("b"), EndKey: roachpb.Key("c")},
+		ExciseSpan:    roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("d")},
+	}
+	err := validateExciseSpan(args)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not contained in request span")
+}
+
+// TestValidateExciseSpanAllowsContainedSpan ensures the common case -- an
+// ExciseSpan equal to or narrower than the request span -- is still allowed.
+func TestValidateExciseSpanAllowsContainedSpan(t *testing.T) {
+	args := &roachpb.AddSSTableRequest{
+		RequestHeader: roachpb.RequestHeader{Key: roachpb.Key("a"), EndKey: roachpb.Key("z")},
+		ExciseSpan:    roachpb.Span{Key: roachpb.Key("b"), EndKey: roachpb.Key("c")},
+	}
+	require.NoError(t, validateExciseSpan(args))
+}
+
+// TestExcisePreIngestSpanClearsExistingData is a regression test for the
+// excise-then-ingest flow: excisePreIngestSpan must actually remove the
+// existing data in the span (not merely account for it in stats), so that
+// installing the SST afterward replaces rather than merges with what was
+// there.
+func TestExcisePreIngestSpanClearsExistingData(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	eng := engine.NewDefaultInMem()
+	defer eng.Close()
+
+	require.NoError(t, eng.Put(engine.MVCCKey{Key: roachpb.Key("bbb")}, []byte("stale")))
+
+	ms := &enginepb.MVCCStats{}
+	excise := roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("z")}
+	result, err := excisePreIngestSpan(ctx, eng, ms, excise)
+	require.NoError(t, err)
+	require.Equal(t, excise, result.Span)
+
+	iter := eng.NewIterator(engine.IterOptions{UpperBound: roachpb.Key("z")})
+	defer iter.Close()
+	iter.Seek(engine.MVCCKey{Key: roachpb.Key("a")})
+	ok, err := iter.Valid()
+	require.NoError(t, err)
+	require.False(t, ok, "excised key still present after excisePreIngestSpan")
+}
+
+// TestExciseCoversRequestSpan is a regression test: an ExciseSpan narrower
+// than the request span doesn't clear everything the SST could touch, so
+// the resulting stats must stay flagged as estimates even though an excise
+// happened. Only an ExciseSpan that covers the whole request span makes the
+// post-excise stats exact.
+func TestExciseCoversRequestSpan(t *testing.T) {
+	reqSpan := roachpb.RequestHeader{Key: roachpb.Key("a"), EndKey: roachpb.Key("z")}
+	excised := &storagepb.ReplicatedEvalResult_Excise{}
+
+	narrower := &roachpb.AddSSTableRequest{
+		RequestHeader: reqSpan,
+		ExciseSpan:    roachpb.Span{Key: roachpb.Key("b"), EndKey: roachpb.Key("c")},
+	}
+	require.False(t, exciseCoversRequestSpan(narrower, excised),
+		"an ExciseSpan narrower than the request span must not be treated as exact")
+
+	fullSpan := &roachpb.AddSSTableRequest{
+		RequestHeader: reqSpan,
+		ExciseSpan:    roachpb.Span{Key: roachpb.Key("a"), EndKey: roachpb.Key("z")},
+	}
+	require.True(t, exciseCoversRequestSpan(fullSpan, excised))
+
+	require.False(t, exciseCoversRequestSpan(fullSpan, nil), "no excise happened")
+}
@@ -0,0 +1,102 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package batcheval
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func writePointSST(t *testing.T, kvs map[string]string) []byte {
+	t.Helper()
+	sst := engine.MakeRocksDBSstFileWriter()
+	defer sst.Close()
+	for k, v := range kvs {
+		require.NoError(t, sst.Put(engine.MVCCKey{Key: roachpb.Key(k)}, []byte(v)))
+	}
+	data, err := sst.Finish()
+	require.NoError(t, err)
+	return data
+}
+
+// TestMergeCheckKeyCollisionsIgnoresExistingOnlyKeys is a regression test for
+// the common case of IMPORT INTO a non-empty table: a preexisting key that
+// the ingested SST doesn't touch must not be reported as a collision.
+func TestMergeCheckKeyCollisionsIgnoresExistingOnlyKeys(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	eng := engine.NewDefaultInMem()
+	defer eng.Close()
+
+	// "bbb" exists in the range already and is not present in the SST below.
+	require.NoError(t, eng.Put(engine.MVCCKey{Key: roachpb.Key("bbb")}, []byte("existing")))
+
+	data := writePointSST(t, map[string]string{"ccc": "new"})
+
+	mvccStartKey, mvccEndKey := engine.MVCCKey{Key: roachpb.Key("a")}, engine.MVCCKey{Key: roachpb.Key("z")}
+	_, err := mergeCheckKeyCollisions(ctx, eng, mvccStartKey, mvccEndKey, data, 0)
+	require.NoError(t, err)
+}
+
+// TestMergeCheckKeyCollisionsDetectsRealCollision ensures an actual collision
+// (same key, different value) is still rejected by the merging pass.
+func TestMergeCheckKeyCollisionsDetectsRealCollision(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	eng := engine.NewDefaultInMem()
+	defer eng.Close()
+
+	require.NoError(t, eng.Put(engine.MVCCKey{Key: roachpb.Key("bbb")}, []byte("existing")))
+
+	data := writePointSST(t, map[string]string{"bbb": "new"})
+
+	mvccStartKey, mvccEndKey := engine.MVCCKey{Key: roachpb.Key("a")}, engine.MVCCKey{Key: roachpb.Key("z")}
+	_, err := mergeCheckKeyCollisions(ctx, eng, mvccStartKey, mvccEndKey, data, 0)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "collides with an existing key")
+}
+
+// TestMergeCheckKeyCollisionsRejectsNewerShadowingWrite ensures the
+// MergeDeltaSSTWins case -- the SST carries the same key at a newer
+// timestamp with a different value, so it would "win" if merged -- is
+// still treated as a collision under DisallowShadowing rather than as a
+// legal overwrite. Only an equal-timestamp, equal-value "perfect shadow"
+// is allowed to pass through as a no-op.
+func TestMergeCheckKeyCollisionsRejectsNewerShadowingWrite(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	eng := engine.NewDefaultInMem()
+	defer eng.Close()
+
+	require.NoError(t, eng.Put(
+		engine.MVCCKey{Key: roachpb.Key("bbb"), Timestamp: hlc.Timestamp{WallTime: 1}}, []byte("existing")))
+
+	sst := engine.MakeRocksDBSstFileWriter()
+	defer sst.Close()
+	require.NoError(t, sst.Put(
+		engine.MVCCKey{Key: roachpb.Key("bbb"), Timestamp: hlc.Timestamp{WallTime: 2}}, []byte("new")))
+	data, err := sst.Finish()
+	require.NoError(t, err)
+
+	mvccStartKey, mvccEndKey := engine.MVCCKey{Key: roachpb.Key("a")}, engine.MVCCKey{Key: roachpb.Key("z")}
+	_, err = mergeCheckKeyCollisions(ctx, eng, mvccStartKey, mvccEndKey, data, 0)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "collides with an existing key")
+}
@@ -0,0 +1,111 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package batcheval
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/storage/engine"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+// writeRangeTombstoneSST builds an in-memory SST containing a single
+// RANGEDEL covering [start, end), for use as test input to the
+// range-tombstone helpers in cmd_add_sstable.go.
+func writeRangeTombstoneSST(t *testing.T, start, end roachpb.Key) []byte {
+	t.Helper()
+	sst := engine.MakeRocksDBSstFileWriter()
+	defer sst.Close()
+	require.NoError(t, sst.ClearRange(engine.MVCCKey{Key: start}, engine.MVCCKey{Key: end}))
+	data, err := sst.Finish()
+	require.NoError(t, err)
+	return data
+}
+
+func TestVerifyAndComputeRangeKeyStatsRejectsOutOfBoundsRangeKey(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	data := writeRangeTombstoneSST(t, roachpb.Key("a"), roachpb.Key("z"))
+	rangeKeyIter, err := engine.NewMemSSTRangeKeyIterator(data)
+	require.NoError(t, err)
+	defer rangeKeyIter.Close()
+
+	// The request range [b, c) is narrower than the RANGEDEL [a, z), so this
+	// must be rejected rather than silently truncated.
+	_, err = verifyAndComputeRangeKeyStats(
+		rangeKeyIter, engine.MVCCKey{Key: roachpb.Key("b")}, engine.MVCCKey{Key: roachpb.Key("c")}, 0)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not in request range")
+}
+
+func TestCheckRangeTombstoneCollisionsDetectsCoveredLiveKey(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	eng := engine.NewDefaultInMem()
+	defer eng.Close()
+
+	// A live key in the middle of the span the ingested range tombstone will
+	// cover.
+	require.NoError(t, eng.Put(engine.MVCCKey{Key: roachpb.Key("bbb")}, []byte("v")))
+
+	data := writeRangeTombstoneSST(t, roachpb.Key("a"), roachpb.Key("z"))
+	rangeKeyIter, err := engine.NewMemSSTRangeKeyIterator(data)
+	require.NoError(t, err)
+	defer rangeKeyIter.Close()
+
+	mvccStartKey, mvccEndKey := engine.MVCCKey{Key: roachpb.Key("a")}, engine.MVCCKey{Key: roachpb.Key("z")}
+	err = checkRangeTombstoneCollisions(ctx, eng, mvccStartKey, mvccEndKey, rangeKeyIter)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "collides with an existing key")
+}
+
+// TestCheckRangeTombstoneCollisionsIgnoresDeletedKey is a regression test:
+// a raw iterator surfaces deletion-tombstone versions (an empty value) too,
+// so a RANGEDEL covering only an already-deleted key must not be reported
+// as a collision -- only a live key makes it one.
+func TestCheckRangeTombstoneCollisionsIgnoresDeletedKey(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	eng := engine.NewDefaultInMem()
+	defer eng.Close()
+
+	// "bbb" is already a deletion tombstone (empty value), not a live key.
+	require.NoError(t, eng.Put(engine.MVCCKey{Key: roachpb.Key("bbb")}, nil))
+
+	data := writeRangeTombstoneSST(t, roachpb.Key("a"), roachpb.Key("z"))
+	rangeKeyIter, err := engine.NewMemSSTRangeKeyIterator(data)
+	require.NoError(t, err)
+	defer rangeKeyIter.Close()
+
+	mvccStartKey, mvccEndKey := engine.MVCCKey{Key: roachpb.Key("a")}, engine.MVCCKey{Key: roachpb.Key("z")}
+	require.NoError(t, checkRangeTombstoneCollisions(ctx, eng, mvccStartKey, mvccEndKey, rangeKeyIter))
+}
+
+func TestCheckRangeTombstoneCollisionsAllowsEmptySpan(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	eng := engine.NewDefaultInMem()
+	defer eng.Close()
+
+	data := writeRangeTombstoneSST(t, roachpb.Key("a"), roachpb.Key("z"))
+	rangeKeyIter, err := engine.NewMemSSTRangeKeyIterator(data)
+	require.NoError(t, err)
+	defer rangeKeyIter.Close()
+
+	mvccStartKey, mvccEndKey := engine.MVCCKey{Key: roachpb.Key("a")}, engine.MVCCKey{Key: roachpb.Key("z")}
+	require.NoError(t, checkRangeTombstoneCollisions(ctx, eng, mvccStartKey, mvccEndKey, rangeKeyIter))
+}
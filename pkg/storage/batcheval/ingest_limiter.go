@@ -0,0 +1,162 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package batcheval
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"golang.org/x/time/rate"
+)
+
+// ingestByteRateLimit and ingestRequestRateLimit bound how fast a single
+// store will admit AddSSTable evaluations, so that a large concurrent IMPORT
+// cannot flood a store with collision scans and stats computation before
+// Raft even sees the proposals. A rate of 0 disables the corresponding
+// bucket.
+var ingestByteRateLimit = settings.RegisterByteSizeSetting(
+	"kv.bulk_io_write.addsstable_byte_rate_limit",
+	"maximum throughput, in bytes/sec, of AddSSTable evaluation allowed per store (0 disables the limit)",
+	1<<30, // 1 GiB/s
+)
+
+var ingestRequestRateLimit = settings.RegisterFloatSetting(
+	"kv.bulk_io_write.addsstable_request_rate_limit",
+	"maximum number of AddSSTable evaluations per second allowed per store (0 disables the limit)",
+	0,
+)
+
+// IngestLimiterMetrics are the Prometheus metrics exposed by an IngestLimiter.
+type IngestLimiterMetrics struct {
+	WaitTime   *metric.Histogram
+	QueueDepth *metric.Gauge
+}
+
+// MetricStruct implements the metric.Struct interface.
+func (IngestLimiterMetrics) MetricStruct() {}
+
+func makeIngestLimiterMetrics() IngestLimiterMetrics {
+	return IngestLimiterMetrics{
+		WaitTime: metric.NewHistogram(metric.Metadata{
+			Name: "addsstable.admission.wait_time",
+			Help: "Time spent waiting on the AddSSTable admission limiter",
+		}, time.Minute, metric.IOLatencyBuckets),
+		QueueDepth: metric.NewGauge(metric.Metadata{
+			Name: "addsstable.admission.queue_depth",
+			Help: "Number of AddSSTable evaluations currently waiting on the admission limiter",
+		}),
+	}
+}
+
+// IngestLimiter rate-limits EvalAddSSTable's admission of work onto a store,
+// using a byte/sec token bucket charged the SST payload size plus a
+// requests/sec bucket, and backs off automatically when the store's LSM is
+// under compaction stress (analogous to Pebble's write-stall thresholds for
+// memtable flushes and L0 growth).
+type IngestLimiter struct {
+	sv      *settings.Values
+	metrics IngestLimiterMetrics
+
+	bytes    *rate.Limiter
+	requests *rate.Limiter
+
+	// l0SublevelPressure reports the store's current L0 file count/sublevel
+	// pressure, so ingests can be throttled the same way Pebble throttles
+	// memtable flushes under compaction debt.
+	l0SublevelPressure func() float64
+}
+
+// NewIngestLimiter constructs an IngestLimiter for a single store, reading
+// its rate limits from sv and reporting compaction pressure via
+// l0SublevelPressure.
+func NewIngestLimiter(sv *settings.Values, l0SublevelPressure func() float64) *IngestLimiter {
+	l := &IngestLimiter{
+		sv:                 sv,
+		metrics:            makeIngestLimiterMetrics(),
+		bytes:              rate.NewLimiter(rate.Inf, 1),
+		requests:           rate.NewLimiter(rate.Inf, 1),
+		l0SublevelPressure: l0SublevelPressure,
+	}
+	l.refresh()
+	return l
+}
+
+// Metrics returns the limiter's Prometheus metrics for registration with the
+// store's metric registry.
+func (l *IngestLimiter) Metrics() IngestLimiterMetrics {
+	return l.metrics
+}
+
+func (l *IngestLimiter) refresh() {
+	if b := ingestByteRateLimit.Get(l.sv); b > 0 {
+		l.bytes.SetLimit(rate.Limit(b))
+		// Size the burst independently of the rate, large enough to admit
+		// the largest SST we expect to see, so WaitN waits for tokens
+		// instead of rejecting an oversized request outright.
+		l.bytes.SetBurst(ingestByteRateBurst)
+	} else {
+		l.bytes.SetLimit(rate.Inf)
+	}
+	if r := ingestRequestRateLimit.Get(l.sv); r > 0 {
+		l.requests.SetLimit(rate.Limit(r))
+		l.requests.SetBurst(int(r) + 1)
+	} else {
+		l.requests.SetLimit(rate.Inf)
+	}
+}
+
+// Wait blocks, respecting ctx cancellation, until the limiter has admitted an
+// AddSSTable evaluation of the given payload size. It also backs off while
+// the store reports elevated L0 sublevel pressure, so ingests slow down
+// automatically under compaction stress rather than piling more write
+// amplification onto an already-struggling LSM.
+func (l *IngestLimiter) Wait(ctx context.Context, sstBytes int) error {
+	l.refresh()
+
+	start := timeutil.Now()
+	l.metrics.QueueDepth.Inc(1)
+	defer func() {
+		l.metrics.QueueDepth.Dec(1)
+		l.metrics.WaitTime.RecordValue(timeutil.Since(start).Nanoseconds())
+	}()
+
+	if l.l0SublevelPressure != nil {
+		for l.l0SublevelPressure() > l0SublevelPressureThreshold {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(l0BackoffInterval):
+			}
+		}
+	}
+
+	if err := l.requests.Wait(ctx); err != nil {
+		return err
+	}
+	return l.bytes.WaitN(ctx, sstBytes)
+}
+
+const (
+	// l0SublevelPressureThreshold mirrors Pebble's own L0 write-stall
+	// trigger: once a store reports more sublevel pressure than this,
+	// AddSSTable evaluation backs off rather than adding to the backlog.
+	l0SublevelPressureThreshold = 20
+	l0BackoffInterval           = 10 * time.Millisecond
+
+	// ingestByteRateBurst bounds the byte-rate limiter's burst allowance.
+	// It is deliberately independent of the configured rate and sized well
+	// above any SST AddSSTable is expected to carry, so that oversized (but
+	// legal) requests wait for tokens rather than being rejected by WaitN.
+	ingestByteRateBurst = 2 << 30 // 2 GiB
+)
@@ -0,0 +1,89 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package batcheval
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+// TestIngestLimiterAllowsOversizedSST is a regression test for sizing the
+// byte-rate limiter's burst independently of its configured rate: without
+// that, any SST larger than one second's worth of the configured rate would
+// be rejected by WaitN instead of waiting for tokens.
+func TestIngestLimiterAllowsOversizedSST(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	sv := &cluster.MakeTestingClusterSettings().SV
+	ingestByteRateLimit.Override(sv, 1<<20) // 1 MiB/s
+
+	l := NewIngestLimiter(sv, nil)
+	// 16 MiB is many seconds' worth of the configured rate, and must still be
+	// accepted rather than failing outright.
+	require.NoError(t, l.Wait(ctx, 16<<20))
+}
+
+// TestIngestLimiterBacksOffUnderL0Pressure verifies that Wait blocks while
+// l0SublevelPressure reports pressure above the threshold, and returns once
+// it drops, rather than admitting the request immediately regardless of
+// compaction stress.
+func TestIngestLimiterBacksOffUnderL0Pressure(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	sv := &cluster.MakeTestingClusterSettings().SV
+
+	// l.Wait polls l0SublevelPressure from its own goroutine, so the reported
+	// pressure must be stored behind an atomic rather than a plain float64 to
+	// avoid a race between that goroutine's reads and this test's write below.
+	var pressure atomic.Value
+	pressure.Store(l0SublevelPressureThreshold + 1.0)
+	l := NewIngestLimiter(sv, func() float64 { return pressure.Load().(float64) })
+
+	done := make(chan error, 1)
+	go func() { done <- l.Wait(context.Background(), 1) }()
+
+	select {
+	case <-done:
+		t.Fatal("Wait returned before L0 pressure dropped")
+	case <-time.After(3 * l0BackoffInterval):
+	}
+
+	pressure.Store(0.0)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not return after L0 pressure dropped")
+	}
+}
+
+// TestIngestLimiterRespectsContextCancellation ensures a canceled context
+// unblocks a pending Wait instead of hanging forever.
+func TestIngestLimiterRespectsContextCancellation(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	sv := &cluster.MakeTestingClusterSettings().SV
+	l := NewIngestLimiter(sv, func() float64 { return l0SublevelPressureThreshold + 1 })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := l.Wait(ctx, 1)
+	require.Error(t, err)
+	require.Equal(t, context.Canceled, err)
+}
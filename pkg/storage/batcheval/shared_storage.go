@@ -0,0 +1,111 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package batcheval
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/pkg/errors"
+)
+
+// SharedStorageProvider resolves an AddSSTableRequest_ExternalRef into a
+// byte stream, without requiring the SST to be copied onto the local node
+// ahead of time. This package includes no implementation; a blob storage
+// backend (S3, GCS, Azure) supplies one and registers it with
+// RegisterSharedStorageProvider under the name it expects to find in
+// ExternalRef.Provider.
+type SharedStorageProvider interface {
+	// ReadObject opens the object at bucket/path for reading. The caller is
+	// responsible for closing the returned ReadCloser.
+	ReadObject(ctx context.Context, bucket, path string) (io.ReadCloser, error)
+}
+
+var sharedStorageProvidersMu sync.Mutex
+var sharedStorageProviders = map[string]SharedStorageProvider{}
+
+// RegisterSharedStorageProvider registers a SharedStorageProvider under the
+// given name so that EvalAddSSTable can resolve AddSSTableRequest_ExternalRef
+// values whose Provider field matches it. It panics if a provider is already
+// registered under name.
+func RegisterSharedStorageProvider(name string, provider SharedStorageProvider) {
+	sharedStorageProvidersMu.Lock()
+	defer sharedStorageProvidersMu.Unlock()
+	if _, ok := sharedStorageProviders[name]; ok {
+		panic("SharedStorageProvider " + name + " already registered")
+	}
+	sharedStorageProviders[name] = provider
+}
+
+// resolveExternalRef streams the SST referenced by ref from shared blob
+// storage and verifies its checksum, returning the raw SST bytes. If no
+// provider is registered for ref.Provider, or a registered provider's
+// ReadObject fails, it falls back to the caller-supplied fallback (a
+// locally-available copy of the same SST), which must pass the same
+// size/checksum verification as a fetch from shared storage would. A
+// checksum mismatch from the provider itself is not masked by the fallback.
+// fallback is nil in the common case where the only copy of the SST lives
+// in shared storage.
+func resolveExternalRef(ctx context.Context, ref roachpb.AddSSTableRequest_ExternalRef, fallback []byte) ([]byte, error) {
+	sharedStorageProvidersMu.Lock()
+	provider, ok := sharedStorageProviders[ref.Provider]
+	sharedStorageProvidersMu.Unlock()
+	if !ok {
+		if len(fallback) > 0 {
+			return verifyExternalRefBytes(ref, fallback)
+		}
+		return nil, errors.Errorf("no SharedStorageProvider registered for %q", ref.Provider)
+	}
+
+	data, err := readExternalRef(ctx, provider, ref)
+	if err != nil {
+		if len(fallback) > 0 {
+			return verifyExternalRefBytes(ref, fallback)
+		}
+		return nil, err
+	}
+	return verifyExternalRefBytes(ref, data)
+}
+
+func readExternalRef(
+	ctx context.Context, provider SharedStorageProvider, ref roachpb.AddSSTableRequest_ExternalRef,
+) ([]byte, error) {
+	r, err := provider.ReadObject(ctx, ref.Bucket, ref.Path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s/%s", ref.Bucket, ref.Path)
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s/%s", ref.Bucket, ref.Path)
+	}
+	return data, nil
+}
+
+// verifyExternalRefBytes checks data against the size and checksum recorded
+// in ref, regardless of whether it came from the registered provider or from
+// a caller-supplied fallback copy -- both must satisfy the same integrity
+// guarantee before EvalAddSSTable is allowed to ingest them.
+func verifyExternalRefBytes(ref roachpb.AddSSTableRequest_ExternalRef, data []byte) ([]byte, error) {
+	if int64(len(data)) != ref.Size {
+		return nil, errors.Errorf("%s/%s: expected %d bytes, got %d", ref.Bucket, ref.Path, ref.Size, len(data))
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], ref.ContentSHA256) {
+		return nil, errors.Errorf("%s/%s: checksum mismatch", ref.Bucket, ref.Path)
+	}
+	return data, nil
+}
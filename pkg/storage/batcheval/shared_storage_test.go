@@ -0,0 +1,154 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package batcheval
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSharedStorageProvider struct {
+	data []byte
+	err  error
+}
+
+func (p fakeSharedStorageProvider) ReadObject(ctx context.Context, bucket, path string) (io.ReadCloser, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return ioutil.NopCloser(bytes.NewReader(p.data)), nil
+}
+
+func externalRefFor(data []byte) roachpb.AddSSTableRequest_ExternalRef {
+	sum := sha256.Sum256(data)
+	return roachpb.AddSSTableRequest_ExternalRef{
+		Provider:      "fake",
+		Bucket:        "bucket",
+		Path:          "path",
+		Size:          int64(len(data)),
+		ContentSHA256: sum[:],
+	}
+}
+
+// TestResolveExternalRefReadsFromProvider covers the common path: the
+// provider returns bytes that match the recorded size and checksum.
+func TestResolveExternalRefReadsFromProvider(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	data := []byte("sst bytes")
+	ref := externalRefFor(data)
+
+	sharedStorageProvidersMu.Lock()
+	sharedStorageProviders[ref.Provider] = fakeSharedStorageProvider{data: data}
+	sharedStorageProvidersMu.Unlock()
+	defer func() {
+		sharedStorageProvidersMu.Lock()
+		delete(sharedStorageProviders, ref.Provider)
+		sharedStorageProvidersMu.Unlock()
+	}()
+
+	got, err := resolveExternalRef(ctx, ref, nil)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
+
+// TestResolveExternalRefUsesFallbackWhenNoProviderRegistered is a regression
+// test for the promised fallback behavior: a node that can't reach the
+// shared bucket at all must still be able to apply the SST from a verified
+// local copy.
+func TestResolveExternalRefUsesFallbackWhenNoProviderRegistered(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	data := []byte("sst bytes")
+	ref := externalRefFor(data)
+	ref.Provider = "unregistered"
+
+	got, err := resolveExternalRef(ctx, ref, data)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
+
+// TestResolveExternalRefRejectsCorruptFallback is a regression test for the
+// bug where a fallback copy was accepted without verification: a fallback
+// that doesn't match ref's recorded checksum must be rejected, not silently
+// ingested.
+func TestResolveExternalRefRejectsCorruptFallback(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	data := []byte("sst bytes")
+	ref := externalRefFor(data)
+	ref.Provider = "unregistered"
+
+	_, err := resolveExternalRef(ctx, ref, []byte("tampered bytes"))
+	require.Error(t, err)
+}
+
+// TestResolveExternalRefUsesFallbackOnProviderReadError is a regression test
+// for the other case the fallback is meant to cover: a registered provider
+// that fails to read the object (e.g. a permission error) is exactly what
+// happens when a follower lacks access to the shared bucket, and must fall
+// back to the verified local copy rather than propagating the read error.
+func TestResolveExternalRefUsesFallbackOnProviderReadError(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	data := []byte("sst bytes")
+	ref := externalRefFor(data)
+
+	sharedStorageProvidersMu.Lock()
+	sharedStorageProviders[ref.Provider] = fakeSharedStorageProvider{err: errors.New("permission denied")}
+	sharedStorageProvidersMu.Unlock()
+	defer func() {
+		sharedStorageProvidersMu.Lock()
+		delete(sharedStorageProviders, ref.Provider)
+		sharedStorageProvidersMu.Unlock()
+	}()
+
+	got, err := resolveExternalRef(ctx, ref, data)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
+
+// TestResolveExternalRefDoesNotMaskChecksumFailureWithFallback is a
+// regression test for the bug where a checksum/size failure from the
+// registered provider would fall back to an unverified local copy instead
+// of surfacing the failure -- masking a corrupt or tampered shared object.
+func TestResolveExternalRefDoesNotMaskChecksumFailureWithFallback(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	data := []byte("sst bytes")
+	ref := externalRefFor(data)
+
+	sharedStorageProvidersMu.Lock()
+	sharedStorageProviders[ref.Provider] = fakeSharedStorageProvider{data: []byte("corrupted in shared storage")}
+	sharedStorageProvidersMu.Unlock()
+	defer func() {
+		sharedStorageProvidersMu.Lock()
+		delete(sharedStorageProviders, ref.Provider)
+		sharedStorageProvidersMu.Unlock()
+	}()
+
+	_, err := resolveExternalRef(ctx, ref, data)
+	require.Error(t, err)
+}